@@ -0,0 +1,254 @@
+package ollama
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/relay/channel/openai"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ChatRequest 对应 Ollama `/api/chat` 的请求体
+type ChatRequest struct {
+	Model    string         `json:"model"`
+	Messages []ChatMessage  `json:"messages"`
+	Stream   bool           `json:"stream"`
+	Options  map[string]any `json:"options,omitempty"`
+}
+
+// ChatMessage 是 Ollama 消息的最小表示，role/content 与 OpenAI 一致
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// ChatResponseChunk 对应 Ollama `/api/chat` NDJSON 流中的一行
+type ChatResponseChunk struct {
+	Model           string      `json:"model"`
+	CreatedAt       string      `json:"created_at"`
+	Message         ChatMessage `json:"message"`
+	Done            bool        `json:"done"`
+	EvalCount       int         `json:"eval_count"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+// ConvertRequest 把 OpenAI Chat Completions 请求体转换为 Ollama `/api/chat` 请求体
+func ConvertRequest(textRequest openai.GeneralOpenAIRequest) *ChatRequest {
+	messages := make([]ChatMessage, 0, len(textRequest.Messages))
+	for _, m := range textRequest.Messages {
+		messages = append(messages, ChatMessage{
+			Role:    m.Role,
+			Content: m.StringContent(),
+		})
+	}
+	return &ChatRequest{
+		Model:    textRequest.Model,
+		Messages: messages,
+		Stream:   textRequest.Stream,
+	}
+}
+
+// streamResponse2OpenAI 把一行 Ollama NDJSON chunk 转换为 OpenAI 的 SSE delta chunk
+func streamResponse2OpenAI(chunk ChatResponseChunk) *openai.ChatCompletionsStreamResponse {
+	var finishReason *string
+	if chunk.Done {
+		stop := "stop"
+		finishReason = &stop
+	}
+	choice := openai.ChatCompletionsStreamResponseChoice{
+		Index: 0,
+		Delta: openai.ChatCompletionsStreamResponseChoiceDelta{
+			Content: chunk.Message.Content,
+		},
+		FinishReason: finishReason,
+	}
+	return &openai.ChatCompletionsStreamResponse{
+		Id:      fmt.Sprintf("chatcmpl-%s", common.GetUUID()),
+		Object:  "chat.completion.chunk",
+		Created: common.GetTimestamp(),
+		Model:   chunk.Model,
+		Choices: []openai.ChatCompletionsStreamResponseChoice{choice},
+	}
+}
+
+// StreamHandler 读取 Ollama `/api/chat` 返回的换行分隔 JSON（NDJSON），
+// 逐行转换为 OpenAI 兼容的 SSE `data: {...}` 帧后转发给客户端。processors 是
+// openai 包里那条 StreamProcessor 流水线（脱敏、固定文案、结构化校验、用量重算……），
+// 复用同一套内置 processor 使 Ollama 上游的行为与 openai channel 保持一致。
+func StreamHandler(c *gin.Context, resp *http.Response, processors ...openai.StreamProcessor) (*openai.ErrorWithStatusCode, *openai.Usage) {
+	chain := openai.NewStreamProcessorChain(processors...)
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	dataChan := make(chan string)
+	stopChan := make(chan bool)
+	usage := &openai.Usage{}
+
+	go func() {
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var chunk ChatResponseChunk
+			if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+				common.SysError("error unmarshalling ollama ndjson chunk: " + err.Error())
+				continue
+			}
+
+			sc := &openai.StreamChoice{Content: chunk.Message.Content}
+			if chunk.Done {
+				stop := "stop"
+				sc.FinishReason = &stop
+			}
+			extraDeltas := chain.OnDelta(sc)
+			if sc.FinishReason != nil {
+				extraDeltas = append(extraDeltas, chain.OnFinish(sc)...)
+			}
+			chunk.Message.Content = sc.Content
+
+			streamResponse := streamResponse2OpenAI(chunk)
+			jsonBytes, err := json.Marshal(streamResponse)
+			if err != nil {
+				common.SysError("error marshalling translated stream response: " + err.Error())
+				continue
+			}
+			dataChan <- "data: " + string(jsonBytes)
+			for _, d := range extraDeltas {
+				if rendered := openai.RenderDeltaFrame(d); rendered != "" {
+					dataChan <- rendered
+				}
+			}
+			if chunk.Done {
+				usage.PromptTokens = chunk.PromptEvalCount
+				usage.CompletionTokens = chunk.EvalCount
+				usage.TotalTokens = chunk.PromptEvalCount + chunk.EvalCount
+			}
+		}
+		dataChan <- "data: [DONE]"
+		stopChan <- true
+	}()
+
+	common.SetEventStreamHeaders(c)
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case data := <-dataChan:
+			c.Render(-1, common.CustomEvent{Data: data})
+			return true
+		case <-stopChan:
+			return false
+		}
+	})
+	if err := resp.Body.Close(); err != nil {
+		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+	return nil, usage
+}
+
+// Handler 聚合 Ollama `/api/chat` 在 stream=false 时返回的单个（或多行 NDJSON 累积的）
+// JSON 对象，组装为 OpenAI 的 SlimTextResponse 返回给客户端，并像 openai.Handler 一样
+// 跑一遍 processors 流水线（固定文案、结构化校验……）。
+func Handler(c *gin.Context, resp *http.Response, promptTokens int, model_ string, processors ...openai.StreamProcessor) (*openai.ErrorWithStatusCode, *openai.Usage) {
+	chain := openai.NewStreamProcessorChain(processors...)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return openai.ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil
+	}
+	if err := resp.Body.Close(); err != nil {
+		return openai.ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), nil
+	}
+
+	var content strings.Builder
+	var last ChatResponseChunk
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var chunk ChatResponseChunk
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return openai.ErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError), nil
+		}
+		content.WriteString(chunk.Message.Content)
+		last = chunk
+	}
+
+	completionTokens := last.EvalCount
+	if completionTokens == 0 {
+		completionTokens = openai.CountTokenText(content.String(), model_)
+	}
+	usage := &openai.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+	if last.PromptEvalCount != 0 {
+		usage.PromptTokens = last.PromptEvalCount
+		usage.TotalTokens = last.PromptEvalCount + completionTokens
+	}
+
+	encodedContent, err := json.Marshal(content.String())
+	if err != nil {
+		return openai.ErrorWrapper(err, "encode_content_failed", http.StatusInternalServerError), nil
+	}
+	textResponse := openai.SlimTextResponse{
+		Choices: []openai.TextResponseChoice{
+			{
+				Index: 0,
+				Message: openai.Message{
+					Role:    "assistant",
+					Content: encodedContent,
+				},
+				FinishReason: "stop",
+			},
+		},
+		Usage: *usage,
+	}
+
+	// 依次运行后处理流水线（追加固定文案 -> 结构化校验 -> 用量重算……）
+	chain.OnFinalResponse(&textResponse)
+
+	// response_schema strict 模式下校验失败必须在这里转换成 422，而不能让无效内容
+	// 跟着下面的 200 一起发出去；best-effort 模式下把警告转换成响应头
+	var schemaWarning string
+	for _, p := range processors {
+		validator, ok := p.(*openai.SchemaValidatorProcessor)
+		if !ok || validator == nil {
+			continue
+		}
+		if validator.Err != nil {
+			return &openai.ErrorWithStatusCode{
+				Error: openai.Error{
+					Message: validator.Err.Error(),
+					Type:    "invalid_json_schema",
+				},
+				StatusCode: http.StatusUnprocessableEntity,
+			}, nil
+		}
+		if validator.Warning != "" {
+			schemaWarning = validator.Warning
+		}
+	}
+
+	responseBody, err := json.Marshal(textResponse)
+	if err != nil {
+		return openai.ErrorWrapper(err, "remarshal_response_body_failed", http.StatusInternalServerError), nil
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	if schemaWarning != "" {
+		c.Writer.Header().Set("X-Response-Schema-Warning", schemaWarning)
+	}
+	c.Writer.WriteHeader(http.StatusOK)
+	if _, err := c.Writer.Write(responseBody); err != nil {
+		return openai.ErrorWrapper(err, "write_modified_response_body_failed", http.StatusInternalServerError), nil
+	}
+	return nil, &textResponse.Usage
+}
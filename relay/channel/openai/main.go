@@ -1,9 +1,7 @@
 package openai
 
 import (
-	"bufio"
 	"encoding/json"
-	"fmt"
 	"io"
 	"net/http"
 	"one-api/common"
@@ -14,112 +12,151 @@ import (
 )
 
 // GenerateFixedContentMessage 生成包含固定文本内容的消息
+//
+// Deprecated: 固定文案注入现在由 FixedFooterProcessor（见 processor_builtin.go）
+// 负责，保留此函数仅为兼容仍在直接调用它的旧代码。
 func GenerateFixedContentMessage(fixedContent string) string {
-	// 在 fixedContent 的开始处添加换行符
-	modifiedFixedContent := "\n\n" + fixedContent
-
-	content := map[string]interface{}{
-		"id":      fmt.Sprintf("chatcmpl-%s", common.GetUUID()),
-		"object":  "chat.completion",
-		"created": common.GetTimestamp(), // 这里可能需要根据实际情况动态生成
-		"choices": []map[string]interface{}{
-			{
-				"index":         0,
-				"finish_reason": "stop",
-				"delta": map[string]string{
-					"content": modifiedFixedContent, // 使用修改后的 fixedContent，其中包括前置换行符
-					"role":    "",
-				},
-			},
-		},
-	}
-
-	// 将 content 转换为 JSON 字符串
-	jsonBytes, err := json.Marshal(content)
-	if err != nil {
-		common.SysError("error marshalling fixed content message: " + err.Error())
-		return ""
-	}
-
-	return "data: " + string(jsonBytes)
+	stop := "stop"
+	return RenderDeltaFrame(Delta{Content: "\n\n" + fixedContent, FinishReason: &stop})
 }
 
-func StreamHandler(c *gin.Context, resp *http.Response, relayMode int, fixedContent string) (*ErrorWithStatusCode, string) {
+// StreamHandler 扫描上游 SSE 响应并转发给客户端。processors 是按注册顺序
+// 组成的后处理流水线（脱敏、固定文案、结构化校验、用量重算……），取代了
+// 原先硬编码在本函数里的 needInjectFixedMessageBeforeNextSend 逻辑。
+//
+// reader 为 nil 时使用默认缓冲大小新建一个 SSEReader；非 OpenAI 上游（Anthropic 的
+// message_delta/content_block_delta 等）需要先自行 NewSSEReader 并 RegisterEventDecoder，
+// 再把配置好的 reader 传进来，否则注册的解码器永远不会被用到。
+func StreamHandler(c *gin.Context, resp *http.Response, relayMode int, promptTokens int, model string, reader *SSEReader, processors ...StreamProcessor) (*ErrorWithStatusCode, string, []Usage) {
 	responseText := ""
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		if atEOF && len(data) == 0 {
-			return 0, nil, nil
-		}
-		if i := strings.Index(string(data), "\n"); i >= 0 {
-			return i + 1, data[0:i], nil
-		}
-		if atEOF {
-			return len(data), data, nil
-		}
-		return 0, nil, nil
-	})
+	chain := NewStreamProcessorChain(processors...)
+	if reader == nil {
+		reader = NewSSEReader(resp.Body, 0)
+	}
+	aggregator := NewStreamUsageAggregator(model, promptTokens)
 	dataChan := make(chan string)
 	stopChan := make(chan bool)
 
 	go func() {
-		var needInjectFixedMessageBeforeNextSend = false
-		for scanner.Scan() {
-
-			data := scanner.Text()
-			if len(data) < 6 { // ignore blank line or wrong format
-				continue
+		for {
+			event, ok := reader.Next()
+			if !ok {
+				break
 			}
-			if data[:6] != "data: " && data[:6] != "[DONE]" {
+			// 已注册自定义解码器的事件类型交给调用方提供的 decoder 处理；其余事件
+			// （包括没有 event: 字段的裸 event，如 OpenAI）按 data 字段的 JSON 解析
+			if decoder := reader.Decoder(event.Event); decoder != nil {
+				content, finishReason, usage, err := decoder(event)
+				if err != nil {
+					common.SysError("error decoding custom sse event: " + err.Error())
+					continue
+				}
+				responseText += content
+				aggregator.ObserveDelta(0, content, "", "")
+				if usage != nil {
+					aggregator.TrustUpstreamUsage(*usage)
+				}
+				sc := &StreamChoice{Content: content}
+				if finishReason != "" {
+					sc.FinishReason = &finishReason
+				}
+				extraDeltas := chain.OnDelta(sc)
+				if sc.FinishReason != nil {
+					extraDeltas = append(extraDeltas, chain.OnFinish(sc)...)
+				}
+				dataChan <- RenderDeltaFrame(Delta{Content: sc.Content, FinishReason: sc.FinishReason})
+				for _, d := range extraDeltas {
+					if rendered := RenderDeltaFrame(d); rendered != "" {
+						dataChan <- rendered
+					}
+				}
 				continue
 			}
-			// 检查是否需要在下一次发送前注入固定消息
-			if needInjectFixedMessageBeforeNextSend {
-				if fixedContent != "" {
-					fixedContentMessage := GenerateFixedContentMessage(fixedContent)
-					dataChan <- fixedContentMessage              // 先发送固定内容
-					needInjectFixedMessageBeforeNextSend = false // 重置标记
-				}
 
+			if event.Data == "" {
+				continue // 空事件（例如只有 retry: 字段），忽略
+			}
+			if event.Data == "[DONE]" {
+				continue // 上游的结束标记，本函数末尾会统一补发
 			}
 
-			if data[:6] == "data: " {
-				if data == "data: [DONE]" {
-					continue // 跳过当前循环迭代，不执行JSON解析
+			jsonData := event.Data
+			data := renderRawSSEFrame(event)
+			var extraDeltas []Delta
+			switch relayMode {
+			case constant.RelayModeChatCompletions:
+				var streamResponse ChatCompletionsStreamResponse
+				err := json.Unmarshal([]byte(jsonData), &streamResponse)
+				if err != nil {
+					common.SysError("error unmarshalling stream response: " + err.Error())
+					continue // just ignore the error
 				}
-
-				jsonData := data[6:]
-				switch relayMode {
-				case constant.RelayModeChatCompletions:
-					var streamResponse ChatCompletionsStreamResponse
-					err := json.Unmarshal([]byte(jsonData), &streamResponse)
-					if err != nil {
-						common.SysError("error unmarshalling stream response: " + err.Error())
-						continue // just ignore the error
+				if streamResponse.Usage != nil {
+					// 上游开启了 stream_options.include_usage，直接采信它给出的数字
+					aggregator.TrustUpstreamUsage(*streamResponse.Usage)
+				}
+				mutated := false
+				for i := range streamResponse.Choices {
+					choice := &streamResponse.Choices[i]
+					responseText += choice.Delta.Content
+					toolCallArgs, functionNames := toolCallTokenSources(choice.Delta.ToolCalls)
+					aggregator.ObserveDelta(choice.Index, choice.Delta.Content, toolCallArgs, functionNames)
+					sc := &StreamChoice{Index: choice.Index, Content: choice.Delta.Content, FinishReason: choice.FinishReason}
+					extraDeltas = append(extraDeltas, chain.OnDelta(sc)...)
+					if sc.Content != choice.Delta.Content {
+						choice.Delta.Content = sc.Content
+						mutated = true
 					}
-					for _, choice := range streamResponse.Choices {
-						responseText += choice.Delta.Content
-						if choice.FinishReason != nil && *choice.FinishReason == "stop" {
-							needInjectFixedMessageBeforeNextSend = true
-						}
+					if choice.FinishReason != nil && *choice.FinishReason == "stop" {
+						extraDeltas = append(extraDeltas, chain.OnFinish(sc)...)
 					}
-				case constant.RelayModeCompletions:
-					var streamResponse CompletionsStreamResponse
-					err := json.Unmarshal([]byte(jsonData), &streamResponse)
-					if err != nil {
-						common.SysError("error unmarshalling stream response: " + err.Error())
-						continue
+				}
+				// 只有 processor 真的改过 Delta.Content 才重新序列化，否则原样转发上游这一行，
+				// 避免 ChatCompletionsStreamResponse 没建模的字段（如 logprobs、system_fingerprint、
+				// service_tier）被悄悄丢掉
+				if mutated {
+					modifiedBytes, err := json.Marshal(streamResponse)
+					if err == nil {
+						data = "data: " + string(modifiedBytes)
 					}
-					for _, choice := range streamResponse.Choices {
-						responseText += choice.Text
-						if choice.FinishReason == "stop" {
-							needInjectFixedMessageBeforeNextSend = true
-						}
+				}
+			case constant.RelayModeCompletions:
+				var streamResponse CompletionsStreamResponse
+				err := json.Unmarshal([]byte(jsonData), &streamResponse)
+				if err != nil {
+					common.SysError("error unmarshalling stream response: " + err.Error())
+					continue
+				}
+				mutated := false
+				for i := range streamResponse.Choices {
+					choice := &streamResponse.Choices[i]
+					responseText += choice.Text
+					aggregator.ObserveDelta(choice.Index, choice.Text, "", "")
+					finishReason := choice.FinishReason
+					sc := &StreamChoice{Index: choice.Index, Content: choice.Text, FinishReason: &finishReason}
+					extraDeltas = append(extraDeltas, chain.OnDelta(sc)...)
+					if sc.Content != choice.Text {
+						choice.Text = sc.Content
+						mutated = true
+					}
+					if choice.FinishReason == "stop" {
+						extraDeltas = append(extraDeltas, chain.OnFinish(sc)...)
+					}
+				}
+				// 只有 processor 真的改过 Text 才重新序列化，否则原样转发上游这一行
+				if mutated {
+					modifiedBytes, err := json.Marshal(streamResponse)
+					if err == nil {
+						data = "data: " + string(modifiedBytes)
 					}
 				}
 			}
-			if !needInjectFixedMessageBeforeNextSend {
-				dataChan <- data // 如果不需要注入，则正常发送数据
+
+			dataChan <- data
+			for _, d := range extraDeltas {
+				if rendered := RenderDeltaFrame(d); rendered != "" {
+					dataChan <- rendered
+				}
 			}
 		}
 
@@ -144,14 +181,17 @@ func StreamHandler(c *gin.Context, resp *http.Response, relayMode int, fixedCont
 	})
 	err := resp.Body.Close()
 	if err != nil {
-		return ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), ""
+		return ErrorWrapper(err, "close_response_body_failed", http.StatusInternalServerError), "", nil
 	}
-	return nil, responseText
+	// fixedContent 之类由 processor 在 OnFinish 中追加的文案不计入 completion tokens，
+	// 因为它从未被送入 aggregator（只有 ObserveDelta 观察到的原始增量才计数）
+	return nil, responseText, aggregator.Finalize()
 }
 
-func Handler(c *gin.Context, resp *http.Response, promptTokens int, model string, fixedContent string) (*ErrorWithStatusCode, *Usage, string) {
+func Handler(c *gin.Context, resp *http.Response, promptTokens int, model string, processors ...StreamProcessor) (*ErrorWithStatusCode, *Usage, string) {
 	var textResponse SlimTextResponse
 	var responseText string
+	chain := NewStreamProcessorChain(processors...)
 	responseBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return ErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError), nil, ""
@@ -173,22 +213,10 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, model string
 	for _, choice := range textResponse.Choices {
 		responseText = choice.Message.StringContent()
 	}
-	// 在响应文本中插入固定内容，并构建包含 fixedContent 的 responseText
-	if fixedContent != "" {
-		for i, choice := range textResponse.Choices {
-			modifiedContent := choice.Message.StringContent() + "\n\n" + fixedContent
-			// 使用json.Marshal确保字符串被正确编码为JSON
-			encodedContent, err := json.Marshal(modifiedContent)
-			if err != nil {
-				return ErrorWrapper(err, "encode_modified_content_failed", http.StatusInternalServerError), nil, ""
-			}
-			textResponse.Choices[i].Message.Content = json.RawMessage(encodedContent)
-		}
-	}
 
-	// Token 的计算使用原始响应文本而不包括 fixedContent
+	// Token 的计算使用原始响应文本，不包括后面流水线里追加的固定文案等内容
 	if textResponse.Usage.TotalTokens == 0 {
-		completionTokens := CountTokenText(responseText, model) // 假设 CountTokenText 可以正确计算
+		completionTokens := CountTokenText(responseText, model)
 		textResponse.Usage = Usage{
 			PromptTokens:     promptTokens,
 			CompletionTokens: completionTokens,
@@ -196,17 +224,48 @@ func Handler(c *gin.Context, resp *http.Response, promptTokens int, model string
 		}
 	}
 
+	// 依次运行后处理流水线（脱敏 -> 追加固定文案 -> 结构化校验 -> 用量重算……）
+	chain.OnFinalResponse(&textResponse)
+
+	// response_schema strict 模式下校验失败必须在这里转换成 422，而不能让无效内容
+	// 跟着下面的 200 一起发出去；best-effort 模式下把警告转换成响应头
+	var schemaWarning string
+	for _, p := range processors {
+		validator, ok := p.(*SchemaValidatorProcessor)
+		if !ok || validator == nil {
+			continue
+		}
+		if validator.Err != nil {
+			return &ErrorWithStatusCode{
+				Error: Error{
+					Message: validator.Err.Error(),
+					Type:    "invalid_json_schema",
+				},
+				StatusCode: http.StatusUnprocessableEntity,
+			}, nil, ""
+		}
+		if validator.Warning != "" {
+			schemaWarning = validator.Warning
+		}
+	}
+
+	if len(textResponse.Choices) > 0 {
+		responseText = textResponse.Choices[0].Message.StringContent()
+	}
+
 	// 将更新后的响应发送给客户端
 	modifiedResponseBody, err := json.Marshal(textResponse)
 	if err != nil {
 		return ErrorWrapper(err, "remarshal_response_body_failed", http.StatusInternalServerError), nil, ""
 	}
 
-	c.Writer.WriteHeader(resp.StatusCode)
-
 	for k, v := range resp.Header {
 		c.Writer.Header().Set(k, v[0])
 	}
+	if schemaWarning != "" {
+		c.Writer.Header().Set("X-Response-Schema-Warning", schemaWarning)
+	}
+	c.Writer.WriteHeader(resp.StatusCode)
 	_, err = c.Writer.Write(modifiedResponseBody)
 	if err != nil {
 		return ErrorWrapper(err, "write_modified_response_body_failed", http.StatusInternalServerError), nil, ""
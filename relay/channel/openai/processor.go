@@ -0,0 +1,127 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"one-api/common"
+)
+
+// Delta 是 StreamProcessor 产出的、需要额外下发给客户端的一条增量内容。
+// 它与协议无关，由 RenderDeltaFrame 负责渲染成具体的 SSE `data: {...}` 帧。
+type Delta struct {
+	Content string
+	Role    string
+	// FinishReason 为 nil 表示这还不是该 choice 的最后一帧（如自定义事件解码器
+	// 产出的中间 content_block_delta），渲染时 finish_reason 留空；非 nil
+	// （通常是 "stop"）才代表这是收尾帧，例如追加的固定文案或校验后的整段回放。
+	FinishReason *string
+	// Err 非 nil 时表示这不是一条普通增量，而是一帧需要直接下发给客户端的错误帧
+	// （例如 response_schema strict 模式校验失败），渲染时会忽略 Content/Role/FinishReason。
+	Err error
+}
+
+// StreamChoice 是传给 StreamProcessor 的统一视图，屏蔽了 chat/completions 两种
+// 协议在 delta 字段命名上的差异（Delta.Content vs Text）。processor 可以原地修改
+// Content 字段（例如脱敏），核心扫描循环会把修改后的内容写回原始响应结构。
+type StreamChoice struct {
+	Index        int
+	Content      string
+	FinishReason *string
+}
+
+// StreamProcessor 是可插拔的流式后处理器。注册在某个 channel/token 上的一组
+// StreamProcessor 按顺序组成一条流水线，替代原先硬编码在核心扫描循环里的
+// fixedContent 注入逻辑，使其他维护者可以在不改动核心循环的前提下扩展行为
+// （脱敏、结构化校验、用量重算……），并支持任意组合。
+type StreamProcessor interface {
+	// OnDelta 在每个正常的增量 chunk 到达时调用，可以原地修改 choice.Content，
+	// 返回需要在该 chunk 之后额外下发的 Delta 列表（通常为空）。
+	OnDelta(choice *StreamChoice) []Delta
+	// OnFinish 在某个 choice 收到 finish_reason（如 "stop"）时调用一次，
+	// 返回需要追加下发的 Delta 列表（例如固定文案、校验后的整段 JSON）。
+	OnFinish(choice *StreamChoice) []Delta
+	// OnFinalResponse 在非流式 Handler 整理完最终响应后调用，允许就地修改
+	// 返回给客户端的 SlimTextResponse（例如改写 Message.Content、重算 Usage）。
+	OnFinalResponse(resp *SlimTextResponse)
+}
+
+// StreamProcessorChain 按注册顺序依次驱动一组 StreamProcessor。
+type StreamProcessorChain struct {
+	processors []StreamProcessor
+}
+
+// NewStreamProcessorChain 按给定顺序组装一条处理链，nil processor 会被忽略。
+func NewStreamProcessorChain(processors ...StreamProcessor) *StreamProcessorChain {
+	chain := &StreamProcessorChain{}
+	for _, p := range processors {
+		if p != nil {
+			chain.processors = append(chain.processors, p)
+		}
+	}
+	return chain
+}
+
+func (chain *StreamProcessorChain) OnDelta(choice *StreamChoice) []Delta {
+	if chain == nil {
+		return nil
+	}
+	var out []Delta
+	for _, p := range chain.processors {
+		out = append(out, p.OnDelta(choice)...)
+	}
+	return out
+}
+
+func (chain *StreamProcessorChain) OnFinish(choice *StreamChoice) []Delta {
+	if chain == nil {
+		return nil
+	}
+	var out []Delta
+	for _, p := range chain.processors {
+		out = append(out, p.OnFinish(choice)...)
+	}
+	return out
+}
+
+func (chain *StreamProcessorChain) OnFinalResponse(resp *SlimTextResponse) {
+	if chain == nil {
+		return
+	}
+	for _, p := range chain.processors {
+		p.OnFinalResponse(resp)
+	}
+}
+
+// RenderDeltaFrame 把一个 Delta 渲染成一帧独立的 SSE `data: {...}` 消息，
+// 结构与 GenerateFixedContentMessage 保持一致，导出给其他 channel 包
+// （如 ollama）复用，使它们也能接入同一套 StreamProcessor 流水线。
+func RenderDeltaFrame(d Delta) string {
+	if d.Err != nil {
+		return "data: " + schemaErrorFrame(d.Err)
+	}
+	var finishReason interface{}
+	if d.FinishReason != nil {
+		finishReason = *d.FinishReason
+	}
+	content := map[string]interface{}{
+		"id":      fmt.Sprintf("chatcmpl-%s", common.GetUUID()),
+		"object":  "chat.completion.chunk",
+		"created": common.GetTimestamp(),
+		"choices": []map[string]interface{}{
+			{
+				"index":         0,
+				"finish_reason": finishReason,
+				"delta": map[string]string{
+					"content": d.Content,
+					"role":    d.Role,
+				},
+			},
+		},
+	}
+	jsonBytes, err := json.Marshal(content)
+	if err != nil {
+		common.SysError("error marshalling processor delta frame: " + err.Error())
+		return ""
+	}
+	return "data: " + string(jsonBytes)
+}
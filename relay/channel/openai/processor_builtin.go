@@ -0,0 +1,167 @@
+package openai
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// FixedFooterProcessor 把原来硬编码在 StreamHandler/Handler 里的
+// "在回复结束后追加一段固定文案" 迁移成一个内置 processor。
+type FixedFooterProcessor struct {
+	Content string
+}
+
+func (p *FixedFooterProcessor) OnDelta(_ *StreamChoice) []Delta { return nil }
+
+func (p *FixedFooterProcessor) OnFinish(_ *StreamChoice) []Delta {
+	if p.Content == "" {
+		return nil
+	}
+	stop := "stop"
+	return []Delta{{Content: "\n\n" + p.Content, FinishReason: &stop}}
+}
+
+func (p *FixedFooterProcessor) OnFinalResponse(resp *SlimTextResponse) {
+	if p.Content == "" || len(resp.Choices) == 0 {
+		return
+	}
+	for i, choice := range resp.Choices {
+		modified := choice.Message.StringContent() + "\n\n" + p.Content
+		encoded, err := json.Marshal(modified)
+		if err != nil {
+			continue
+		}
+		resp.Choices[i].Message.Content = json.RawMessage(encoded)
+	}
+}
+
+// RedactProcessor 对下行内容做正则/关键词脱敏，适用于屏蔽内部提示词、密钥等敏感片段。
+type RedactProcessor struct {
+	Patterns    []*regexp.Regexp
+	Replacement string
+}
+
+// NewKeywordRedactProcessor 是 RedactProcessor 的便捷构造函数，按普通关键词（而非正则）脱敏。
+func NewKeywordRedactProcessor(keywords []string, replacement string) *RedactProcessor {
+	patterns := make([]*regexp.Regexp, 0, len(keywords))
+	for _, kw := range keywords {
+		if kw == "" {
+			continue
+		}
+		patterns = append(patterns, regexp.MustCompile(regexp.QuoteMeta(kw)))
+	}
+	return &RedactProcessor{Patterns: patterns, Replacement: replacement}
+}
+
+func (p *RedactProcessor) redact(content string) string {
+	for _, pattern := range p.Patterns {
+		content = pattern.ReplaceAllString(content, p.Replacement)
+	}
+	return content
+}
+
+func (p *RedactProcessor) OnDelta(choice *StreamChoice) []Delta {
+	choice.Content = p.redact(choice.Content)
+	return nil
+}
+
+func (p *RedactProcessor) OnFinish(_ *StreamChoice) []Delta { return nil }
+
+func (p *RedactProcessor) OnFinalResponse(resp *SlimTextResponse) {
+	for i, choice := range resp.Choices {
+		redacted := p.redact(choice.Message.StringContent())
+		encoded, err := json.Marshal(redacted)
+		if err != nil {
+			continue
+		}
+		resp.Choices[i].Message.Content = json.RawMessage(encoded)
+	}
+}
+
+// SchemaValidatorProcessor 把 response_schema 模式（见 schema.go）接入流水线：
+// 流式时缓冲全部增量直到 finish_reason=stop，再执行提取 -> 校验 -> (失败则重试)，
+// 最终把校验通过的 JSON 整体回放为一个 Delta；非流式时在 OnFinalResponse 里原地校验。
+//
+// OnFinalResponse/OnFinish 本身不返回 error（遵循 StreamProcessor 接口约定），
+// strict 模式下校验失败时把错误记录在 Err 里，调用方在运行完流水线后应检查
+// Err 并据此把响应转换为 422 invalid_json_schema；OnFinish 额外会把同一个错误
+// 包装成一帧 error chunk 直接下发给客户端，因为流式响应此时已经发出了 200。
+// best-effort 模式下重试耗尽仍未通过校验时，Warning 会被置上，调用方应该把它
+// 转换成 X-Response-Schema-Warning 响应头。
+type SchemaValidatorProcessor struct {
+	Options *ResponseSchemaOptions
+	Retry   RetryCompletionFunc
+
+	Err     error
+	Warning string
+
+	buffer strings.Builder
+}
+
+func (p *SchemaValidatorProcessor) OnDelta(choice *StreamChoice) []Delta {
+	p.buffer.WriteString(choice.Content)
+	choice.Content = "" // 缓冲模式下抑制逐字输出，等校验通过后整体回放
+	return nil
+}
+
+func (p *SchemaValidatorProcessor) OnFinish(_ *StreamChoice) []Delta {
+	content, ok, err := validateStructuredOutput(p.buffer.String(), p.Options, p.Retry)
+	if err != nil {
+		p.Err = err
+		// strict 模式下响应头早已发出，没法再改成 422，只能在流里补发一帧错误
+		// 让客户端能感知到校验失败，而不是静默收到一个空的 [DONE]
+		return []Delta{{Err: err}}
+	}
+	if !ok {
+		p.Warning = "validation failed after retries, returning best-effort content"
+	}
+	stop := "stop"
+	return []Delta{{Content: content, Role: "assistant", FinishReason: &stop}}
+}
+
+func (p *SchemaValidatorProcessor) OnFinalResponse(resp *SlimTextResponse) {
+	if len(resp.Choices) == 0 {
+		return
+	}
+	content, ok, err := validateStructuredOutput(resp.Choices[0].Message.StringContent(), p.Options, p.Retry)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	if !ok {
+		p.Warning = "validation failed after retries, returning best-effort content"
+	}
+	encoded, err := json.Marshal(content)
+	if err != nil {
+		p.Err = err
+		return
+	}
+	resp.Choices[0].Message.Content = json.RawMessage(encoded)
+}
+
+// TokenUsageRecomputeProcessor 在上游没有返回可信用量时，用 CountTokenText
+// 基于最终下发给客户端的文本重新计算 completion_tokens，避免把 processor
+// 自行追加的内容（如 FixedFooterProcessor 的文案）之外的偏差带入计费。
+type TokenUsageRecomputeProcessor struct {
+	Model        string
+	PromptTokens int
+}
+
+func (p *TokenUsageRecomputeProcessor) OnDelta(_ *StreamChoice) []Delta  { return nil }
+func (p *TokenUsageRecomputeProcessor) OnFinish(_ *StreamChoice) []Delta { return nil }
+
+func (p *TokenUsageRecomputeProcessor) OnFinalResponse(resp *SlimTextResponse) {
+	if resp.Usage.TotalTokens != 0 {
+		return
+	}
+	if len(resp.Choices) == 0 {
+		return
+	}
+	completionTokens := CountTokenText(resp.Choices[0].Message.StringContent(), p.Model)
+	resp.Usage = Usage{
+		PromptTokens:     p.PromptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      p.PromptTokens + completionTokens,
+	}
+}
@@ -0,0 +1,201 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"one-api/common"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ResponseSchemaOptions 描述结构化输出（JSON Schema）校验相关的配置，
+// 对应 relay 请求里可选的 response_schema 字段。
+type ResponseSchemaOptions struct {
+	Schema      json.RawMessage // 用户提供的 JSON Schema
+	MaxRetry    int             // 校验失败后的最大重试次数，默认为 0（不重试）
+	Strict      bool            // true: 重试耗尽后返回 422；false: 返回最后一次尝试的结果并附带警告
+	ContentPath string          // gpath 风格的取值路径，默认 "choices.0.message.content"
+}
+
+// defaultContentPath 是未设置 ContentPath 时使用的默认取值路径，对应
+// OpenAI Chat Completions 响应里 choices[0].message.content 的位置。
+const defaultContentPath = "choices.0.message.content"
+
+// extractContentByPath 按 gpath 风格的路径（用 "." 分隔字段名和数组下标，
+// 例如 "choices.0.message.content"）从任意 JSON 响应体里取出字符串内容。
+// 这是 content_path 选项存在的原因：非 OpenAI 上游的重试响应可能不是
+// SlimTextResponse 的形状，调用方可以指定路径而不用改动这里的代码。
+func extractContentByPath(body []byte, path string) (string, error) {
+	if path == "" {
+		path = defaultContentPath
+	}
+	var root interface{}
+	if err := json.Unmarshal(body, &root); err != nil {
+		return "", fmt.Errorf("content_path %q: response is not valid JSON: %w", path, err)
+	}
+	cur := root
+	for _, segment := range strings.Split(path, ".") {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return "", fmt.Errorf("content_path %q: field %q not found", path, segment)
+			}
+			cur = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", fmt.Errorf("content_path %q: invalid array index %q", path, segment)
+			}
+			cur = node[index]
+		default:
+			return "", fmt.Errorf("content_path %q: cannot descend into %q, reached a %T", path, segment, cur)
+		}
+	}
+	content, ok := cur.(string)
+	if !ok {
+		return "", fmt.Errorf("content_path %q: resolved value is not a string", path)
+	}
+	return content, nil
+}
+
+// RetryCompletionFunc 由调用方提供：当结构化输出校验失败时，
+// 用校验错误信息拼接追加提示后重新发起一次 completion 请求。
+type RetryCompletionFunc func(validationError string) (*http.Response, error)
+
+var fencedJSONPattern = regexp.MustCompile("(?s)```(?:json)?\\s*(.*?)\\s*```")
+
+// extractJSONCandidate 从模型输出中提取第一个可能的 JSON 对象/数组。
+// 依次尝试：整段内容本身、```json 围栏代码块、内容中第一个花括号/方括号包裹的片段。
+func extractJSONCandidate(content string) (string, bool) {
+	trimmed := strings.TrimSpace(content)
+	if trimmed == "" {
+		return "", false
+	}
+	if (strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}")) ||
+		(strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]")) {
+		return trimmed, true
+	}
+	if m := fencedJSONPattern.FindStringSubmatch(content); len(m) == 2 {
+		candidate := strings.TrimSpace(m[1])
+		if candidate != "" {
+			return candidate, true
+		}
+	}
+	if start := strings.IndexAny(trimmed, "{["); start >= 0 {
+		open, close := byte('{'), byte('}')
+		if trimmed[start] == '[' {
+			open, close = '[', ']'
+		}
+		depth := 0
+		for i := start; i < len(trimmed); i++ {
+			switch trimmed[i] {
+			case open:
+				depth++
+			case close:
+				depth--
+				if depth == 0 {
+					return trimmed[start : i+1], true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// compileResponseSchema 编译用户提供的 JSON Schema。
+func compileResponseSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("response_schema.json", strings.NewReader(string(schema))); err != nil {
+		return nil, fmt.Errorf("invalid response_schema: %w", err)
+	}
+	return compiler.Compile("response_schema.json")
+}
+
+// validateJSONCandidate 将候选 JSON 字符串解析后交给编译好的 schema 校验。
+func validateJSONCandidate(candidate string, compiled *jsonschema.Schema) error {
+	var v interface{}
+	if err := json.Unmarshal([]byte(candidate), &v); err != nil {
+		return fmt.Errorf("response is not valid JSON: %w", err)
+	}
+	return compiled.Validate(v)
+}
+
+// schemaErrorFrame 在 strict 模式下把校验失败包装成一个可以直接发给客户端的 error chunk，
+// 供 RenderDeltaFrame 在 Delta.Err 非 nil 时直接渲染成 SSE 帧。
+func schemaErrorFrame(err error) string {
+	chunk := map[string]interface{}{
+		"error": map[string]string{
+			"message": err.Error(),
+			"type":    "invalid_json_schema",
+		},
+	}
+	jsonBytes, marshalErr := json.Marshal(chunk)
+	if marshalErr != nil {
+		common.SysError("error marshalling schema error frame: " + marshalErr.Error())
+		return "{}"
+	}
+	return string(jsonBytes)
+}
+
+// extractRetryContent 从一次重试补全的响应体中按 opts.ContentPath 提取纯文本内容
+// （重试请求始终以非流式方式发起）。
+func extractRetryContent(resp *http.Response, contentPath string) (string, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	return extractContentByPath(body, contentPath)
+}
+
+// validateStructuredOutput 对一次补全的文本内容执行"提取 -> 校验 -> (失败则重试)"循环。
+// 返回值：result 是最终通过校验的 JSON 字符串，best-effort 放弃时则是最后一次尝试的
+// 原始内容（可能不是合法 JSON）；validated 为 true 当且仅当 result 真正通过了 schema 校验。strict 模式下重试耗尽仍未通过会返回非 nil
+// error，调用方必须检查该 error 并据此把响应转换成 422 invalid_json_schema；best-effort
+// 模式下重试耗尽仍未通过时 err 为 nil 但 validated 为 false，调用方应据此附加警告响应头——
+// 不能仅凭 err == nil 就认为 result 是合法的。
+func validateStructuredOutput(content string, opts *ResponseSchemaOptions, retry RetryCompletionFunc) (result string, validated bool, err error) {
+	compiled, err := compileResponseSchema(opts.Schema)
+	if err != nil {
+		return "", false, err
+	}
+
+	attempt := content
+	var lastErr error
+	for try := 0; ; try++ {
+		candidate, ok := extractJSONCandidate(attempt)
+		if !ok {
+			lastErr = fmt.Errorf("no JSON object or array found in response")
+		} else if err := validateJSONCandidate(candidate, compiled); err != nil {
+			lastErr = err
+		} else {
+			return candidate, true, nil
+		}
+
+		if try >= opts.MaxRetry || retry == nil {
+			break
+		}
+		common.SysLog(fmt.Sprintf("response_schema validation failed (attempt %d/%d): %s", try+1, opts.MaxRetry, lastErr.Error()))
+		resp, err := retry(lastErr.Error())
+		if err != nil {
+			return "", false, fmt.Errorf("retry completion failed: %w", err)
+		}
+		attempt, err = extractRetryContent(resp, opts.ContentPath)
+		if err != nil {
+			return "", false, fmt.Errorf("retry completion failed: %w", err)
+		}
+	}
+
+	if opts.Strict {
+		return "", false, lastErr
+	}
+	// best-effort: 返回最后一次尝试的原始内容（可能不是合法 JSON），validated=false
+	// 告知调用方它从未通过校验，需要附加警告响应头
+	return attempt, false, nil
+}
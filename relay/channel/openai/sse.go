@@ -0,0 +1,132 @@
+package openai
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// defaultSSEMaxBufferSize 是 SSEReader 允许单行（例如一个 data: 行）达到的最大字节数。
+// bufio.Scanner 的默认上限是 64KiB，工具调用参数（tool_call arguments）经常超过这个值，
+// 所以这里把上限提高到 4MiB。
+const defaultSSEMaxBufferSize = 4 << 20
+
+// SSEEvent 是按 SSE 规范解析出来的一条事件。
+// 规范允许一条事件跨多行 `data:` 字段，解析时会把它们按 \n 拼接成一个 Data。
+type SSEEvent struct {
+	Event string // event: 字段，裸 data: 行（如 OpenAI）该字段为空
+	Data  string // 一条事件内所有 data: 行用 \n 拼接后的内容
+	ID    string // id: 字段
+	Retry string // retry: 字段
+}
+
+// EventDecoder 供非 OpenAI 上游（Anthropic 的 message_delta/content_block_delta、
+// Gemini 等）注册自定义事件类型解码逻辑，把特定 event 类型翻译成纯文本增量。
+// usage 仅在该事件携带了上游自己的用量信息时非 nil（例如 Anthropic 的
+// message_delta.usage），供 StreamUsageAggregator 直接采信。
+type EventDecoder func(event *SSEEvent) (content string, finishReason string, usage *Usage, err error)
+
+// SSEReader 按 SSE 规范（而非简单按 \n 切分）解析响应体：
+//   - 连续的 data: 行拼接为一个事件（用 \n 连接），而不是各自独立处理
+//   - 空行派发一个事件；流末尾未以空行结束的残留字段也作为最后一个事件派发
+//   - 以 `:` 开头的行是注释（如 `:heartbeat`），忽略
+//   - event:/id:/retry: 字段会被保留并暴露给调用方
+//   - 兼容 `\r\n` 和 `\n` 两种换行
+type SSEReader struct {
+	scanner  *bufio.Scanner
+	decoders map[string]EventDecoder
+}
+
+// NewSSEReader 创建一个 SSEReader。maxBufferSize<=0 时使用 defaultSSEMaxBufferSize。
+func NewSSEReader(body io.Reader, maxBufferSize int) *SSEReader {
+	if maxBufferSize <= 0 {
+		maxBufferSize = defaultSSEMaxBufferSize
+	}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBufferSize)
+	return &SSEReader{scanner: scanner, decoders: make(map[string]EventDecoder)}
+}
+
+// RegisterEventDecoder 为某个 event 类型注册自定义解码器，非 OpenAI 上游可以借此
+// 把 Anthropic 的 `message_delta`/`content_block_delta` 之类的事件接入统一处理流程。
+func (r *SSEReader) RegisterEventDecoder(eventType string, decoder EventDecoder) {
+	r.decoders[eventType] = decoder
+}
+
+// Decoder 返回为给定 event 类型注册的解码器，不存在时返回 nil。
+func (r *SSEReader) Decoder(eventType string) EventDecoder {
+	return r.decoders[eventType]
+}
+
+// Next 读取并返回下一条 SSE 事件；到达流末尾且没有更多事件时返回 (nil, false)。
+func (r *SSEReader) Next() (*SSEEvent, bool) {
+	var event SSEEvent
+	var dataLines []string
+	haveField := false
+
+	for r.scanner.Scan() {
+		line := strings.TrimSuffix(r.scanner.Text(), "\r")
+
+		if line == "" {
+			if haveField {
+				event.Data = strings.Join(dataLines, "\n")
+				return &event, true
+			}
+			continue // 连续空行或流开头的空行，忽略
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // 注释行
+		}
+
+		field, value := splitSSEField(line)
+		haveField = true
+		switch field {
+		case "data":
+			dataLines = append(dataLines, value)
+		case "event":
+			event.Event = value
+		case "id":
+			event.ID = value
+		case "retry":
+			event.Retry = value
+		}
+	}
+
+	if haveField {
+		event.Data = strings.Join(dataLines, "\n")
+		return &event, true
+	}
+	return nil, false
+}
+
+// splitSSEField 把一行 "field: value" 拆成 field 和 value，按规范去掉 value 前最多一个空格。
+func splitSSEField(line string) (field, value string) {
+	idx := strings.IndexByte(line, ':')
+	if idx < 0 {
+		return line, ""
+	}
+	field = line[:idx]
+	value = strings.TrimPrefix(line[idx+1:], " ")
+	return field, value
+}
+
+// renderRawSSEFrame 把一个未被特殊处理的事件原样重建为可以直接转发给客户端的帧，
+// 多行 data: 按原样重建为多个 data: 行，保留 event 字段（如果有）。
+func renderRawSSEFrame(event *SSEEvent) string {
+	var b strings.Builder
+	if event.Event != "" {
+		b.WriteString("event: " + event.Event + "\n")
+	}
+	if event.Data == "" {
+		b.WriteString("data: ")
+		return b.String()
+	}
+	lines := strings.Split(event.Data, "\n")
+	for i, line := range lines {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("data: " + line)
+	}
+	return b.String()
+}
@@ -0,0 +1,116 @@
+package openai
+
+import (
+	"sort"
+	"strings"
+)
+
+// toolCallTokenSources 从一组增量 tool_call 中提取需要计入 completion tokens 的文本：
+// 函数参数（arguments）和函数名（name）。两者都是模型生成的内容，和普通文本一样计费。
+func toolCallTokenSources(toolCalls []Tool) (arguments string, names string) {
+	var argsBuilder, namesBuilder strings.Builder
+	for _, call := range toolCalls {
+		argsBuilder.WriteString(call.Function.Arguments)
+		namesBuilder.WriteString(call.Function.Name)
+	}
+	return argsBuilder.String(), namesBuilder.String()
+}
+
+// choiceUsageAccumulator 按 choice 累积原始增量文本，供上游没有给出可信用量时退化估算。
+type choiceUsageAccumulator struct {
+	content      strings.Builder
+	toolCallArgs strings.Builder
+	functionName strings.Builder
+}
+
+// StreamUsageAggregator 计算一次流式补全的用量。优先采信上游给出的可信数字
+// （OpenAI 的 stream_options.include_usage、Ollama 的 eval_count/prompt_eval_count、
+// Anthropic 的 message_delta.usage），只有在上游从未给出这些数字时才退化为
+// 按 tiktoken 对每个 choice 累积的文本（含 tool_call 参数和函数名）估算。
+// 这修正了旧实现只拼接 choice.Delta.Content 就整体调用一次 CountTokenText 的问题：
+// 既漏算了 tool_call，也没法在 n>1 时给每个 choice 分别计费。
+type StreamUsageAggregator struct {
+	model        string
+	promptTokens int
+
+	trustedUsage *Usage
+	perChoice    map[int]*choiceUsageAccumulator
+	choiceOrder  []int
+}
+
+// NewStreamUsageAggregator 创建一个用量聚合器；promptTokens 是请求阶段已知的
+// prompt tokens，在没有上游可信数字时作为退化估算的兜底。
+func NewStreamUsageAggregator(model string, promptTokens int) *StreamUsageAggregator {
+	return &StreamUsageAggregator{
+		model:        model,
+		promptTokens: promptTokens,
+		perChoice:    make(map[int]*choiceUsageAccumulator),
+	}
+}
+
+func (a *StreamUsageAggregator) accumulator(index int) *choiceUsageAccumulator {
+	acc, ok := a.perChoice[index]
+	if !ok {
+		acc = &choiceUsageAccumulator{}
+		a.perChoice[index] = acc
+		a.choiceOrder = append(a.choiceOrder, index)
+	}
+	return acc
+}
+
+// ObserveDelta 记录某个 choice 的一次原始增量（文本 + tool_call 参数/函数名），
+// 仅在 Finalize 时没有可信用量可用的情况下才会被实际用到。
+func (a *StreamUsageAggregator) ObserveDelta(index int, content string, toolCallArgs string, functionName string) {
+	acc := a.accumulator(index)
+	acc.content.WriteString(content)
+	acc.toolCallArgs.WriteString(toolCallArgs)
+	acc.functionName.WriteString(functionName)
+}
+
+// TrustUpstreamUsage 记录上游给出的可信用量；一旦调用，Finalize 直接返回它，
+// 不再退化为 tiktoken 估算。多次调用以最后一次为准（例如 Ollama 只有最后一行带 eval_count）。
+func (a *StreamUsageAggregator) TrustUpstreamUsage(usage Usage) {
+	a.trustedUsage = &usage
+}
+
+// Finalize 在有上游可信用量时只返回这一条（不按 choice 拆分）；没有观察到任何 choice
+// 时返回一条只含 prompt tokens 的用量；否则返回每个 choice 的估算用量，按 choice index 升序排列。
+func (a *StreamUsageAggregator) Finalize() []Usage {
+	if a.trustedUsage != nil {
+		return []Usage{*a.trustedUsage}
+	}
+	if len(a.choiceOrder) == 0 {
+		return []Usage{{PromptTokens: a.promptTokens, TotalTokens: a.promptTokens}}
+	}
+
+	indexes := append([]int(nil), a.choiceOrder...)
+	sort.Ints(indexes)
+
+	usages := make([]Usage, 0, len(indexes))
+	for _, idx := range indexes {
+		acc := a.perChoice[idx]
+		completionTokens := CountTokenText(acc.content.String(), a.model) +
+			CountTokenText(acc.toolCallArgs.String(), a.model) +
+			CountTokenText(acc.functionName.String(), a.model)
+		usages = append(usages, Usage{
+			PromptTokens:     a.promptTokens,
+			CompletionTokens: completionTokens,
+			TotalTokens:      a.promptTokens + completionTokens,
+		})
+	}
+	return usages
+}
+
+// WithStreamOptionsIncludeUsage 在转发给 OpenAI 兼容上游的请求体里合并
+// `stream_options: {include_usage: true}`，使上游在流结束时多发一帧包含
+// 精确用量的 usage 帧，StreamUsageAggregator 可以直接采信而不必退化估算。
+func WithStreamOptionsIncludeUsage(requestBody map[string]interface{}) map[string]interface{} {
+	if requestBody == nil {
+		return requestBody
+	}
+	if stream, _ := requestBody["stream"].(bool); !stream {
+		return requestBody
+	}
+	requestBody["stream_options"] = map[string]interface{}{"include_usage": true}
+	return requestBody
+}